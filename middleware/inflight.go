@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// isMutatingMethod reports whether method is one that mutates state, as
+// opposed to a read-only request.
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// MaxInFlightLimiter returns an echo middleware, modeled on Kubernetes'
+// generic apiserver, that caps the number of requests being served
+// concurrently. Read-only requests are limited to maxReadOnly and mutating
+// requests (POST/PUT/PATCH/DELETE) to maxMutating; a limit of 0 disables
+// that bucket. Requests whose path matches longRunning (e.g. log
+// streaming, exec, or watch endpoints vili proxies from kube) are exempt
+// from both limits. Excess requests are rejected with 429 and a
+// Retry-After header. Current in-flight counts are exposed on registry.
+func MaxInFlightLimiter(name string, registry *prometheus.Registry, maxReadOnly, maxMutating int, longRunning *regexp.Regexp) echo.MiddlewareFunc {
+	readOnlyCh := make(chan struct{}, bucketCap(maxReadOnly))
+	mutatingCh := make(chan struct{}, bucketCap(maxMutating))
+
+	inFlight := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "http_requests_limiter_in_flight",
+		Help:      "Number of requests currently held by the in-flight request limiter.",
+	}, []string{"kind"})
+	registry.MustRegister(inFlight)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if longRunning != nil && longRunning.MatchString(req.URL.Path) {
+				return next(c)
+			}
+
+			kind := "readonly"
+			ch, limit := readOnlyCh, maxReadOnly
+			if isMutatingMethod(req.Method) {
+				kind = "mutating"
+				ch, limit = mutatingCh, maxMutating
+			}
+			if limit <= 0 {
+				return next(c)
+			}
+
+			select {
+			case ch <- struct{}{}:
+			default:
+				c.Response().Header().Set("Retry-After", "1")
+				return echo.NewHTTPError(http.StatusTooManyRequests, "too many requests in flight")
+			}
+			defer func() { <-ch }()
+
+			gauge := inFlight.WithLabelValues(kind)
+			gauge.Inc()
+			defer gauge.Dec()
+
+			return next(c)
+		}
+	}
+}
+
+// bucketCap returns a channel capacity for limit. A buffered channel can't
+// have capacity 0 and still be usable as a semaphore, but a disabled
+// bucket (limit <= 0) never touches the channel -- the handler
+// short-circuits on it first -- so any positive capacity is safe.
+func bucketCap(limit int) int {
+	if limit <= 0 {
+		return 1
+	}
+	return limit
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMetricsBuckets are the latency histogram buckets (in seconds) used
+// when a caller does not supply its own via Config.MetricsBuckets.
+var DefaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricsVecs bundles the collectors registered on behalf of the Metrics
+// middleware so they can be created once and shared across requests.
+type metricsVecs struct {
+	requestCount   *prometheus.CounterVec
+	requestLatency *prometheus.HistogramVec
+	inFlight       prometheus.Gauge
+}
+
+// newMetricsVecs creates and registers the collectors used by Metrics
+// against registry.
+func newMetricsVecs(name string, registry *prometheus.Registry, buckets []float64) *metricsVecs {
+	if buckets == nil {
+		buckets = DefaultMetricsBuckets
+	}
+
+	v := &metricsVecs{
+		requestCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: name,
+			Name:      "http_requests_total",
+			Help:      "Total number of HTTP requests handled.",
+		}, []string{"route", "method", "code"}),
+		requestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: name,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests.",
+			Buckets:   buckets,
+		}, []string{"route", "method", "code"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: name,
+			Name:      "http_requests_in_flight",
+			Help:      "Number of HTTP requests currently being served.",
+		}),
+	}
+
+	registry.MustRegister(v.requestCount, v.requestLatency, v.inFlight)
+	return v
+}
+
+// Metrics returns an echo middleware that records request count, in-flight
+// requests, and latency histograms labeled by route, method, and status
+// code against registry. Echo only assigns a status code to an error
+// return once the whole middleware chain has unwound, so errorHandler is
+// invoked here to produce that status before it's read; errorHandler
+// should be the same handler registered as the Echo's HTTPErrorHandler
+// (e.g. Server.httpErrorHandler), and the error is considered handled once
+// passed to it.
+func Metrics(name string, registry *prometheus.Registry, buckets []float64, errorHandler func(error, echo.Context)) echo.MiddlewareFunc {
+	v := newMetricsVecs(name, registry, buckets)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			v.inFlight.Inc()
+			defer v.inFlight.Dec()
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				errorHandler(err, c)
+				err = nil
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = "unknown"
+			}
+			code := strconv.Itoa(c.Response().Status)
+
+			v.requestCount.WithLabelValues(route, c.Request().Method, code).Inc()
+			v.requestLatency.WithLabelValues(route, c.Request().Method, code).Observe(time.Since(start).Seconds())
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsRecordsErrorStatusCode(t *testing.T) {
+	e := echo.New()
+	registry := prometheus.NewRegistry()
+
+	errorHandler := func(err error, c echo.Context) {
+		he := err.(*echo.HTTPError)
+		c.JSON(he.Code, he.Message)
+	}
+
+	mw := Metrics("test", registry, nil, errorHandler)
+	h := mw(func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound, "not found")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if err := h(c); err != nil {
+		t.Fatalf("expected the handled error to be swallowed, got %v", err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("errorHandler did not write the response: got status %d", rec.Code)
+	}
+
+	count := counterValue(t, registry, "test_http_requests_total", map[string]string{
+		"method": http.MethodGet,
+		"code":   "404",
+	})
+	if count != 1 {
+		t.Fatalf("expected http_requests_total{code=\"404\"} to be 1, got %v", count)
+	}
+}
+
+// counterValue looks up a single counter sample matching labels (a subset
+// match -- only the given label names are compared) within metricName.
+func counterValue(t *testing.T, registry *prometheus.Registry, metricName string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %s", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != metricName {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			match := true
+			for _, lp := range m.GetLabel() {
+				if want, ok := labels[lp.GetName()]; ok && want != lp.GetValue() {
+					match = false
+					break
+				}
+			}
+			if match {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	t.Fatalf("no sample for metric %q matching labels %v", metricName, labels)
+	return 0
+}
@@ -2,75 +2,366 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"expvar"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/viliproject/vili/errors"
 	"github.com/viliproject/vili/log"
 	"github.com/viliproject/vili/middleware"
+	"github.com/coreos/go-systemd/activation"
 	"github.com/labstack/echo"
 	mw "github.com/labstack/echo/middleware"
-	"github.com/tylerb/graceful"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 // Server is an instance of the server
 type Server struct {
-	e *echo.Echo
-	c *Config
-	g *graceful.Server
-	t *httptest.Server
+	e   *echo.Echo
+	c   *Config
+	srv *http.Server
+	t   *httptest.Server
+
+	shutdownHooks []shutdownHook
+
+	routeTimeoutsMu sync.RWMutex
+	routeTimeouts   map[string]time.Duration
+}
+
+// shutdownHook is a single named, ordered shutdown step queued via
+// RegisterShutdown.
+type shutdownHook struct {
+	name    string
+	timeout time.Duration
+	fn      func(context.Context) error
+}
+
+// HealthCheck is a single named dependency check run by /admin/ready.
+type HealthCheck struct {
+	Name     string
+	Check    func(ctx context.Context) error
+	Critical bool
+}
+
+// ListenerSpec describes one additional listener Server.Start serves the
+// same routes on, alongside Config.Addr.
+type ListenerSpec struct {
+	// Network is "tcp" or "unix".
+	Network string
+	// Address is a host:port for "tcp" or a socket path for "unix".
+	Address string
+	// TLS, if set, terminates TLS on this listener.
+	TLS *tls.Config
 }
 
 // Config is the configuration for the server
 type Config struct {
-	Name         string
-	Addr         string
-	Timeout      time.Duration
-	HealthCheck  func() error
-	ShutdownFunc func()
-	Middleware   []echo.MiddlewareFunc
+	Name string
+	Addr string
+	// Timeout bounds how long the HTTP server is given to drain in-flight
+	// requests when shutdown begins.
+	Timeout time.Duration
+	// HealthChecks are the named dependency checks run by /admin/ready.
+	// Checks marked Critical must all pass for /admin/ready to report 200;
+	// a failing non-critical check only degrades the reported status.
+	HealthChecks []HealthCheck
+	// HealthCheckTimeout bounds how long a single check in HealthChecks is
+	// given to run before it is treated as failed.
+	HealthCheckTimeout time.Duration
+	Middleware         []echo.MiddlewareFunc
+
+	// MetricsRegistry is the Prometheus registry the metrics middleware
+	// registers its collectors against. If nil, prometheus.NewRegistry()
+	// is used.
+	MetricsRegistry *prometheus.Registry
+	// MetricsBuckets overrides the default latency histogram buckets (in
+	// seconds) used by the metrics middleware.
+	MetricsBuckets []float64
+
+	// MaxRequestsInFlight caps the number of concurrent non-mutating
+	// requests. 0 disables the limit.
+	MaxRequestsInFlight int
+	// MaxMutatingRequestsInFlight caps the number of concurrent
+	// POST/PUT/PATCH/DELETE requests. 0 disables the limit.
+	MaxMutatingRequestsInFlight int
+	// LongRunningRequestRE exempts matching paths from both in-flight
+	// limits above.
+	LongRunningRequestRE *regexp.Regexp
+
+	// RequestTimeout is the default deadline given to a request's context
+	// before it is aborted with a 503. Individual routes can override it
+	// with Server.SetRouteTimeout. 0 disables the default.
+	RequestTimeout time.Duration
+
+	// Listeners are additional listeners Server.Start serves the same
+	// routes on, alongside Addr. Sockets handed to the process via
+	// systemd-style socket activation (LISTEN_FDS) are adopted
+	// automatically and need not be listed here.
+	Listeners []ListenerSpec
 }
 
 // New returns a configured Server struct
 func New(config *Config) *Server {
 	e := echo.New()
 
+	registry := config.MetricsRegistry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+
+	s := &Server{
+		e: e,
+		c: config,
+	}
+
 	// middleware
 	e.Use(mw.Recover())
 	e.Use(echo.MiddlewareFunc(middleware.Logger(config.Name)))
+	e.Use(echo.MiddlewareFunc(middleware.Metrics(config.Name, registry, config.MetricsBuckets, s.httpErrorHandler)))
+	if config.MaxRequestsInFlight > 0 || config.MaxMutatingRequestsInFlight > 0 {
+		e.Use(echo.MiddlewareFunc(middleware.MaxInFlightLimiter(
+			config.Name, registry,
+			config.MaxRequestsInFlight, config.MaxMutatingRequestsInFlight,
+			config.LongRunningRequestRE,
+		)))
+	}
 	for _, middleware := range config.Middleware {
 		e.Use(echo.MiddlewareFunc(middleware))
 	}
+	e.Use(s.requestTimeoutMiddleware)
 
-	e.GET("/admin/health", makeHealthCheck(config.HealthCheck))
-	// TODO admin health details
+	e.GET("/admin/live", liveHandler)
+	e.GET("/admin/ready", makeReadyHandler(config.HealthChecks, config.HealthCheckTimeout))
 	e.GET("/admin/stats", statsHandler)
+	// /admin/stats is kept for backward compatibility alongside the new
+	// Prometheus exposition format.
+	e.GET("/admin/metrics", echo.WrapHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
 	e.POST("/admin/logging/:level", logHandler)
 
-	s := &Server{
-		e: e,
-		c: config,
-	}
 	s.e.HTTPErrorHandler = s.httpErrorHandler
 	return s
 }
 
-// Start starts up the server and begins serving traffic
-func (s *Server) Start() {
-	s.g = &graceful.Server{
-		Server: &http.Server{
-			Addr:    s.c.Addr,
-			Handler: s.e,
-		},
-		Timeout:        s.c.Timeout,
-		BeforeShutdown: s.c.ShutdownFunc,
+// requestTimeoutBody is the JSON body written when a request is aborted by
+// requestTimeoutMiddleware, shaped like errors.ErrorResponse.
+const requestTimeoutBody = `{"error":{"code":503,"message":"Request timeout"}}`
+
+// SetRouteTimeout gives the route identified by method and path its own
+// deadline, overriding Config.RequestTimeout for that route.
+func (s *Server) SetRouteTimeout(method, path string, d time.Duration) {
+	s.routeTimeoutsMu.Lock()
+	defer s.routeTimeoutsMu.Unlock()
+	if s.routeTimeouts == nil {
+		s.routeTimeouts = make(map[string]time.Duration)
+	}
+	s.routeTimeouts[method+" "+path] = d
+}
+
+// routeTimeout returns the deadline configured for method and path, falling
+// back to Config.RequestTimeout.
+func (s *Server) routeTimeout(method, path string) time.Duration {
+	s.routeTimeoutsMu.RLock()
+	d, ok := s.routeTimeouts[method+" "+path]
+	s.routeTimeoutsMu.RUnlock()
+	if ok {
+		return d
+	}
+	return s.c.RequestTimeout
+}
+
+// requestTimeoutMiddleware bounds each request's context.Context to its
+// configured deadline, so handlers -- and any kube API calls they make --
+// are cancelled alongside the client-facing 503.
+//
+// next runs against a Context of its own, built on a buffered
+// ResponseWriter rather than c's, so a handler that's still running once
+// the deadline fires can't race an unrelated request over c's pooled
+// Context or its ResponseWriter after this middleware returns. If next
+// finishes first without an error, its buffered response is copied onto c;
+// if it finishes first with an error, the buffered response is dropped and
+// the error is returned for c's error handling. Otherwise the 503
+// is written directly and the still-running handler is left to finish
+// against its own, unshared Context.
+func (s *Server) requestTimeoutMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		d := s.routeTimeout(c.Request().Method, c.Path())
+		if d <= 0 {
+			return next(c)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), d)
+		defer cancel()
+
+		rec := httptest.NewRecorder()
+		cc := s.e.NewContext(c.Request().WithContext(ctx), rec)
+		cc.SetPath(c.Path())
+		cc.SetParamNames(c.ParamNames()...)
+		cc.SetParamValues(c.ParamValues()...)
+
+		done := make(chan error, 1)
+		go func() { done <- next(cc) }()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				copyResponse(c.Response(), rec)
+			}
+			return err
+		case <-ctx.Done():
+			c.Response().WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(c.Response(), requestTimeoutBody)
+			return nil
+		}
+	}
+}
+
+// copyResponse copies the response buffered in rec onto dst, surfacing a
+// handler's real response once it completes within its deadline.
+func copyResponse(dst *echo.Response, rec *httptest.ResponseRecorder) {
+	for k, vs := range rec.Header() {
+		for _, v := range vs {
+			dst.Header().Add(k, v)
+		}
+	}
+	dst.WriteHeader(rec.Code)
+	dst.Write(rec.Body.Bytes())
+}
+
+// RegisterShutdown queues fn to run, in registration order, once shutdown
+// begins. Each hook is given timeout to complete (0 means it shares the
+// shutdown context's deadline).
+func (s *Server) RegisterShutdown(name string, timeout time.Duration, fn func(context.Context) error) {
+	s.shutdownHooks = append(s.shutdownHooks, shutdownHook{
+		name:    name,
+		timeout: timeout,
+		fn:      fn,
+	})
+}
+
+// Start starts up the server and begins serving the same routes on every
+// configured listener -- Addr, Listeners, and any sockets adopted via
+// systemd-style socket activation. It blocks until ctx is canceled, a
+// SIGINT/SIGTERM is received, or serving on one of the listeners fails, at
+// which point it shuts down the HTTP server, runs the hooks queued with
+// RegisterShutdown, and returns. The listeners are the only components it
+// runs and watches for failure; there is no way to add other background
+// components to this lifecycle.
+func (s *Server) Start(ctx context.Context) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	listeners, err := s.listeners()
+	if err != nil {
+		return err
+	}
+
+	s.srv = &http.Server{Handler: s.e}
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	for _, ln := range listeners {
+		ln := ln
+		g.Go(func() error {
+			log.Infof("Starting server on %s", ln.Addr())
+			if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		select {
+		case sig := <-sigCh:
+			log.Infof("received signal %s, shutting down", sig)
+		case <-gctx.Done():
+			log.Infof("shutting down: %s", gctx.Err())
+		}
+		return s.shutdown(context.Background())
+	})
+
+	return g.Wait()
+}
+
+// listeners builds the full set of listeners Start serves on: one for
+// Config.Addr (if set), one per Config.Listeners entry, and any sockets
+// passed to the process via systemd-style socket activation.
+func (s *Server) listeners() ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	if s.c.Addr != "" {
+		ln, err := net.Listen("tcp", s.c.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("server: listening on %s: %s", s.c.Addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	for _, spec := range s.c.Listeners {
+		ln, err := net.Listen(spec.Network, spec.Address)
+		if err != nil {
+			return nil, fmt.Errorf("server: listening on %s %s: %s", spec.Network, spec.Address, err)
+		}
+		if spec.TLS != nil {
+			ln = tls.NewListener(ln, spec.TLS)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	activated, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("server: adopting activated listeners: %s", err)
+	}
+	listeners = append(listeners, activated...)
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("server: no listeners configured")
 	}
-	log.Infof("Starting server on %s", s.c.Addr)
-	s.g.ListenAndServe()
+
+	return listeners, nil
+}
+
+// shutdown stops the HTTP server and runs the registered shutdown hooks in
+// order.
+func (s *Server) shutdown(ctx context.Context) error {
+	shutdownCtx, cancel := context.WithTimeout(ctx, s.c.Timeout)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("error shutting down http server: %s", err)
+	}
+
+	var firstErr error
+	for _, h := range s.shutdownHooks {
+		hookCtx := shutdownCtx
+		cancel := func() {}
+		if h.timeout > 0 {
+			hookCtx, cancel = context.WithTimeout(shutdownCtx, h.timeout)
+		}
+		log.Infof("running shutdown hook %q", h.name)
+		if err := h.fn(hookCtx); err != nil {
+			log.Errorf("shutdown hook %q failed: %s", h.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		cancel()
+	}
+	return firstErr
 }
 
 // StartTest starts up the test server and begins serving traffic
@@ -80,9 +371,10 @@ func (s *Server) StartTest() string {
 	return s.t.URL
 }
 
-// Stop gracefully shuts down the server
-func (s *Server) Stop() {
-	s.g.Stop(time.Second * 5)
+// Stop gracefully shuts down the server, including running any registered
+// shutdown hooks.
+func (s *Server) Stop(ctx context.Context) error {
+	return s.shutdown(ctx)
 }
 
 // StopTest shuts down the test server
@@ -130,18 +422,86 @@ func (s *Server) Echo() *echo.Echo {
 	return s.e
 }
 
-func makeHealthCheck(hcFunc func() error) func(c echo.Context) error {
+// defaultHealthCheckTimeout bounds an individual check when Config does not
+// set HealthCheckTimeout.
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// checkResult is the JSON shape of a single check in the /admin/ready
+// response.
+type checkResult struct {
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// readyResponse is the JSON body returned by /admin/ready.
+type readyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// liveHandler reports that the process is up and able to serve requests.
+// It does not exercise any dependencies -- that's what /admin/ready is for.
+func liveHandler(c echo.Context) error {
+	return c.NoContent(http.StatusNoContent)
+}
+
+// makeReadyHandler returns a handler that runs checks in parallel, each
+// bounded by timeout (defaultHealthCheckTimeout if <= 0), and reports 200
+// only if every Critical check passes.
+func makeReadyHandler(checks []HealthCheck, timeout time.Duration) echo.HandlerFunc {
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
 	return func(c echo.Context) error {
-		if hcFunc == nil {
-			return echo.NewHTTPError(http.StatusNotImplemented, "Not Implemented")
+		results := make(map[string]checkResult, len(checks))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		critical := true
+
+		for _, hc := range checks {
+			wg.Add(1)
+			go func(hc HealthCheck) {
+				defer wg.Done()
+
+				ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+				defer cancel()
+
+				start := time.Now()
+				err := hc.Check(ctx)
+				res := checkResult{
+					OK:        err == nil,
+					LatencyMs: time.Since(start).Milliseconds(),
+				}
+				if err != nil {
+					res.Error = err.Error()
+				}
+
+				mu.Lock()
+				results[hc.Name] = res
+				if err != nil && hc.Critical {
+					critical = false
+				}
+				mu.Unlock()
+			}(hc)
 		}
+		wg.Wait()
 
-		err := hcFunc()
-		if err != nil {
-			echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		status := http.StatusOK
+		resp := readyResponse{Status: "ok", Checks: results}
+		for _, res := range results {
+			if !res.OK {
+				resp.Status = "degraded"
+				break
+			}
+		}
+		if !critical {
+			resp.Status = "unhealthy"
+			status = http.StatusServiceUnavailable
 		}
-		c.NoContent(http.StatusNoContent)
-		return nil
+
+		return c.JSON(status, resp)
 	}
 }
 